@@ -0,0 +1,129 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pingCommand is sent to health-check a Channel before it's returned to the
+// pool's idle set. Any RPCI-speaking host replies to it, so a failure here
+// means the channel (not just the command) is no longer usable.
+const pingCommand = "ping"
+
+// healthCheckTimeout bounds how long Release waits on the ping round-trip.
+// Send/Receive retry MESSAGE_STATUS_CHECKPOINT in an unbounded loop, and a
+// wedged channel must not be allowed to hold the caller's semaphore slot
+// forever, so the ping uses the *Context variants under this deadline
+// instead.
+const healthCheckTimeout = 5 * time.Second
+
+// ChannelPool multiplexes callers over a bounded set of open Channels.
+// Opening a Channel costs a backdoor round-trip plus hypervisor-side state,
+// so a pool lets many short-lived callers amortize that cost instead of
+// opening one channel per call.
+type ChannelPool struct {
+	proto uint32
+
+	sem chan struct{}
+
+	mu   sync.Mutex
+	idle []*Channel
+}
+
+// NewChannelPool creates a ChannelPool that opens Channels with the given
+// proto and allows at most max of them open at once.
+func NewChannelPool(proto uint32, max int) *ChannelPool {
+	return &ChannelPool{
+		proto: proto,
+		sem:   make(chan struct{}, max),
+	}
+}
+
+// Acquire returns an open Channel, reusing an idle one from the pool if
+// available or opening a new one if the pool hasn't reached its bound. It
+// blocks until a channel is available or ctx is done.
+func (p *ChannelPool) Acquire(ctx context.Context) (*Channel, error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		ch := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return ch, nil
+	}
+	p.mu.Unlock()
+
+	ch, err := NewChannelContext(ctx, p.proto)
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// Release returns ch to the pool. It is health-checked with an RPCI ping
+// first; if the host has torn the channel down, Release transparently
+// closes it and opens a replacement rather than returning a dead channel to
+// the next Acquire caller. If the replacement can't be opened, the channel
+// is simply dropped: its semaphore slot is still freed, and a later Acquire
+// that finds the idle set empty opens a new channel in its place.
+func (p *ChannelPool) Release(ch *Channel) {
+	if ch == nil {
+		<-p.sem
+		return
+	}
+
+	if !p.healthCheck(ch) {
+		ch.Close()
+
+		replacement, err := NewChannel(p.proto)
+		if err != nil {
+			Errorf("ChannelPool: unable to reopen a torn-down channel: %s", err)
+			<-p.sem
+			return
+		}
+		ch = replacement
+	}
+
+	p.mu.Lock()
+	p.idle = append(p.idle, ch)
+	p.mu.Unlock()
+
+	<-p.sem
+}
+
+func (p *ChannelPool) healthCheck(ch *Channel) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	if err := ch.SendContext(ctx, []byte(pingCommand)); err != nil {
+		return false
+	}
+
+	if _, err := ch.ReceiveContext(ctx); err != nil {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,313 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"unsafe"
+
+	"github.com/vmware/vmw-guestinfo/bdoor"
+)
+
+// NewChannelContext opens a new Channel, aborting early if ctx is already
+// canceled or past its deadline before the channel can be opened.
+func NewChannelContext(ctx context.Context, proto uint32) (*Channel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewChannel(proto)
+}
+
+// SendContext behaves like Send, but checks ctx before the initial backdoor
+// call and before every checkpoint retry, bounding the total time spent
+// retrying to ctx's deadline. The guest drives every phase of a Send
+// (SENDSIZE/SENDPAYLOAD or the high-bandwidth equivalent), so unlike
+// ReceiveContext there is no host-owned exchange to tear down on abort:
+// SendContext simply stops issuing further SENDPAYLOAD/HighBandwidthOut
+// calls and returns ctx.Err().
+func (c *Channel) SendContext(ctx context.Context, buf []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+retry:
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	bp := &bdoor.BackdoorProto{}
+	bp.CX.High = messageTypeSendSize
+	bp.CX.Low = bdoor.CommandMessage
+
+	bp.DX.High = c.id
+	bp.SI.SetWord(c.cookie.High.Word())
+	bp.DI.SetWord(c.cookie.Low.Word())
+
+	bp.BX.SetWord(uint32(len(buf)))
+
+	out := bp.InOut()
+	if (out.CX.High & messageStatusSuccess) == 0 {
+		if isCheckpoint(out.CX.High) {
+			Debugf("A checkpoint occurred. Retrying the operation")
+			goto retry
+		}
+
+		Errorf("Message: Unable to send a message over the communication channel %d", c.id)
+		return ErrRpciSend
+	}
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	if !c.forceLowBW && (out.CX.High&messageStatusHighBW) == messageStatusHighBW {
+		hb, err := c.highBWBufferOfSize(len(buf))
+		if err != nil {
+			Errorf("Message: Unable to allocate a high-bandwidth transfer buffer: %s", err)
+			return ErrRpciSend
+		}
+		copy(hb.mem, buf)
+
+		hbbp := &bdoor.BackdoorProto{}
+
+		hbbp.BX.Low = bdoor.CommandHighBWMessage
+		hbbp.BX.High = messageStatusSuccess
+		hbbp.DX.High = c.id
+		hbbp.BP.SetWord(c.cookie.High.Word())
+		hbbp.DI.SetWord(c.cookie.Low.Word())
+		hbbp.CX.SetWord(uint32(len(buf)))
+		hbbp.SI.SetWord(uint32(uintptr(unsafe.Pointer(&hb.mem[0]))))
+
+		out := hbbp.HighBandwidthOut()
+		if (out.BX.High & messageStatusSuccess) == 0 {
+			if isCheckpoint(out.BX.High) {
+				Debugf("A checkpoint occurred. Retrying the operation")
+				goto retry
+			}
+
+			Errorf("Message: Unable to send a message over the communication channel %d", c.id)
+			return ErrRpciSend
+		}
+
+		return nil
+	}
+
+	bp.CX.High = messageTypeSendPayload
+
+	bbuf := bytes.NewBuffer(buf)
+	for {
+		// read 4 bytes at a time
+		words := bbuf.Next(4)
+		if len(words) == 0 {
+			break
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		switch len(words) {
+		case 3:
+			bp.BX.SetWord(binary.LittleEndian.Uint32([]byte{0x0, words[2], words[1], words[0]}))
+		case 2:
+			bp.BX.SetWord(uint32(binary.LittleEndian.Uint16(words)))
+		case 1:
+			bp.BX.SetWord(uint32(words[0]))
+		default:
+			bp.BX.SetWord(binary.LittleEndian.Uint32(words))
+		}
+
+		out = bp.InOut()
+		if (out.CX.High & messageStatusSuccess) == 0 {
+			if isCheckpoint(out.CX.High) {
+				Debugf("A checkpoint occurred. Retrying the operation")
+				goto retry
+			}
+
+			Errorf("Message: Unable to send a message over the communication channel %d", c.id)
+			return ErrRpciSend
+		}
+	}
+
+	return nil
+}
+
+// ReceiveContext behaves like Receive, but checks ctx before the initial
+// backdoor call and before every checkpoint retry, bounding the total time
+// spent retrying to ctx's deadline. If ctx is canceled or its deadline
+// expires while a payload is in flight, ReceiveContext issues a
+// MESSAGE_TYPE_RECEIVEPAYLOAD failure reply so the host's pending
+// SENDPAYLOAD is torn down instead of left in an indeterminate state, and
+// returns ctx.Err().
+func (c *Channel) ReceiveContext(ctx context.Context) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	started := false
+
+retry:
+	// Each goto retry below restarts the RECEIVESIZE handshake from scratch,
+	// so started must not carry over from whatever the previous attempt left
+	// it as: otherwise a cancellation here, before this attempt has a
+	// payload in flight, would fire a RECEIVEPAYLOAD abort reply for a
+	// transfer that no longer exists.
+	started = false
+
+	if err := ctx.Err(); err != nil {
+		if started {
+			c.reply(messageTypeReceivePayload, messageStatusFail)
+		}
+		return nil, err
+	}
+
+	var err error
+	bp := &bdoor.BackdoorProto{}
+	bp.CX.High = messageTypeReceiveSize
+	bp.CX.Low = bdoor.CommandMessage
+
+	bp.DX.High = c.id
+	bp.SI.SetWord(c.cookie.High.Word())
+	bp.DI.SetWord(c.cookie.Low.Word())
+
+	out := bp.InOut()
+	if (out.CX.High & messageStatusSuccess) == 0 {
+		if isCheckpoint(out.CX.High) {
+			Debugf("A checkpoint occurred. Retrying the operation")
+			goto retry
+		}
+
+		Errorf("Message: Unable to poll for messages over the communication channel %d", c.id)
+		return nil, ErrRpciReceive
+	}
+
+	if (out.CX.High & messageStatusDoRecieve) == 0 {
+		Debugf("No message to retrieve")
+		return nil, nil
+	}
+
+	if out.DX.High != messageTypeSendSize {
+		Errorf("Message: Protocol error. Expected a MESSAGE_TYPE_SENDSIZE request from vmware")
+		return nil, ErrRpciReceive
+	}
+
+	size := out.BX.Word()
+
+	var buf []byte
+
+	if size != 0 {
+		started = true
+
+		if !c.forceLowBW && (out.CX.High&messageStatusHighBW == messageStatusHighBW) {
+			buf = make([]byte, size)
+
+			hb, err := c.highBWBufferOfSize(len(buf))
+			if err != nil {
+				Errorf("Message: Unable to allocate a high-bandwidth transfer buffer: %s", err)
+				c.reply(messageTypeReceivePayload, messageStatusFail)
+				return nil, ErrRpciReceive
+			}
+
+			hbbp := &bdoor.BackdoorProto{}
+
+			hbbp.BX.Low = bdoor.CommandHighBWMessage
+			hbbp.BX.High = messageStatusSuccess
+			hbbp.DX.High = c.id
+			hbbp.SI.SetWord(c.cookie.High.Word())
+			hbbp.BP.SetWord(c.cookie.Low.Word())
+			hbbp.CX.SetWord(uint32(len(buf)))
+			hbbp.DI.SetWord(uint32(uintptr(unsafe.Pointer(&hb.mem[0]))))
+
+			out := hbbp.HighBandwidthIn()
+			if (out.BX.High & messageStatusSuccess) == 0 {
+				Errorf("Message: Unable to send a message over the communication channel %d", c.id)
+				c.reply(messageTypeReceivePayload, messageStatusFail)
+				return nil, ErrRpciReceive
+			}
+
+			copy(buf, hb.mem[:len(buf)])
+		} else {
+			b := bytes.NewBuffer(make([]byte, 0, size))
+
+			for {
+				if size == 0 {
+					break
+				}
+
+				if err := ctx.Err(); err != nil {
+					c.reply(messageTypeReceivePayload, messageStatusFail)
+					return nil, err
+				}
+
+				bp.CX.High = messageTypeReceivePayload
+				bp.BX.Low = messageStatusSuccess
+
+				out = bp.InOut()
+				if (out.CX.High & messageStatusSuccess) == 0 {
+					if isCheckpoint(out.CX.High) {
+						Debugf("A checkpoint occurred. Retrying the operation")
+						goto retry
+					}
+
+					Errorf("Message: Unable to receive a message over the communication channel %d", c.id)
+					c.reply(messageTypeReceivePayload, messageStatusFail)
+					return nil, ErrRpciReceive
+				}
+
+				if out.DX.High != messageTypeSendPayload {
+					Errorf("Message: Protocol error. Expected a MESSAGE_TYPE_SENDPAYLOAD from vmware")
+					c.reply(messageTypeReceivePayload, messageStatusFail)
+					return nil, ErrRpciReceive
+				}
+
+				switch size {
+				case 1:
+					err = binary.Write(b, binary.LittleEndian, uint8(out.BX.Low))
+					size = size - 1
+
+				case 2:
+					err = binary.Write(b, binary.LittleEndian, uint16(out.BX.Low))
+					size = size - 2
+
+				case 3:
+					err = binary.Write(b, binary.LittleEndian, uint16(out.BX.Low))
+					if err != nil {
+						c.reply(messageTypeReceivePayload, messageStatusFail)
+						return nil, ErrRpciReceive
+					}
+					err = binary.Write(b, binary.LittleEndian, uint8(out.BX.High))
+					size = size - 3
+
+				default:
+					err = binary.Write(b, binary.LittleEndian, out.BX.Word())
+					size = size - 4
+				}
+
+				if err != nil {
+					Errorf(err.Error())
+					c.reply(messageTypeReceivePayload, messageStatusFail)
+					return nil, ErrRpciReceive
+				}
+			}
+
+			buf = b.Bytes()
+		}
+	}
+
+	c.reply(messageTypeReceiveStatus, messageStatusSuccess)
+
+	return buf, nil
+}
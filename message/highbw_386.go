@@ -0,0 +1,93 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import "syscall"
+
+// defaultHighBWBufferSize is used to size the bounce buffer the first time
+// a high-bandwidth transfer is attempted on a Channel that hasn't had
+// SetHighBWBufferPool called on it explicitly.
+const defaultHighBWBufferSize = 64 * 1024
+
+// highBWBuffer is a fixed region of memory obtained directly from the OS via
+// mmap rather than the Go heap. The backdoor HighBandwidthIn/Out calls hand
+// its address to the hypervisor for DMA; because it is never managed by the
+// Go runtime, it cannot be relocated or freed out from under an in-flight
+// transfer the way a GC-managed []byte can.
+type highBWBuffer struct {
+	mem []byte
+}
+
+func newHighBWBuffer(size int) (*highBWBuffer, error) {
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+
+	return &highBWBuffer{mem: mem}, nil
+}
+
+func (h *highBWBuffer) Close() error {
+	if h == nil || h.mem == nil {
+		return nil
+	}
+
+	err := syscall.Munmap(h.mem)
+	h.mem = nil
+	return err
+}
+
+// SetHighBWBufferPool sizes the pinned bounce buffer a Channel uses for
+// high-bandwidth Send/Receive transfers. It is not required: a buffer of
+// defaultHighBWBufferSize is allocated lazily on first use and grown as
+// needed. Calling it up front avoids that first-use allocation and lets a
+// caller that knows its transfer sizes avoid any later growth.
+func (c *Channel) SetHighBWBufferPool(size int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.setHighBWBuffer(size)
+}
+
+// setHighBWBuffer does the actual allocate-and-swap for SetHighBWBufferPool.
+// Callers must hold c.mu.
+func (c *Channel) setHighBWBuffer(size int) error {
+	buf, err := newHighBWBuffer(size)
+	if err != nil {
+		return err
+	}
+
+	old := c.hbBuf
+	c.hbBuf = buf
+	return old.Close()
+}
+
+// highBWBufferOfSize returns the Channel's pinned bounce buffer, growing
+// (reallocating) it if it is too small for size. Callers must hold c.mu.
+func (c *Channel) highBWBufferOfSize(size int) (*highBWBuffer, error) {
+	if c.hbBuf != nil && len(c.hbBuf.mem) >= size {
+		return c.hbBuf, nil
+	}
+
+	if size < defaultHighBWBufferSize {
+		size = defaultHighBWBufferSize
+	}
+
+	if err := c.setHighBWBuffer(size); err != nil {
+		return nil, err
+	}
+
+	return c.hbBuf, nil
+}
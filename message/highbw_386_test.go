@@ -0,0 +1,86 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+)
+
+// TestHighBWBufferSurvivesGC fills a large transfer buffer, takes the raw
+// pointer HighBandwidthIn/Out would hand to the backdoor, forces GC
+// repeatedly, and then checks that the buffer's address and contents are
+// unchanged. Before the pinned mmap bounce buffer, the
+// equivalent raw &buf[0] pointer into a GC-managed slice could be collected
+// or relocated out from under a transfer like this.
+func TestHighBWBufferSurvivesGC(t *testing.T) {
+	c := &Channel{}
+
+	const size = 1 << 20 // large enough to span several GC-eligible pages
+	want := bytes.Repeat([]byte{0xAB}, size)
+
+	hb, err := c.highBWBufferOfSize(size)
+	if err != nil {
+		t.Fatalf("highBWBufferOfSize: %v", err)
+	}
+	copy(hb.mem, want)
+
+	ptr := &hb.mem[0]
+
+	// Churn garbage and force collection repeatedly while the raw pointer
+	// above is "in flight", simulating GC landing mid-transfer.
+	for i := 0; i < 20; i++ {
+		_ = make([]byte, 1<<20)
+		runtime.GC()
+	}
+
+	if ptr != &hb.mem[0] {
+		t.Fatalf("high-bandwidth buffer moved after GC")
+	}
+
+	if !bytes.Equal(hb.mem[:size], want) {
+		t.Fatalf("high-bandwidth buffer contents changed after GC")
+	}
+
+	if err := c.hbBuf.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestHighBWBufferOfSizeGrows(t *testing.T) {
+	c := &Channel{}
+
+	small, err := c.highBWBufferOfSize(4096)
+	if err != nil {
+		t.Fatalf("highBWBufferOfSize(small): %v", err)
+	}
+	// Growing unmaps the old buffer and sets small.mem to nil, so record
+	// its size now.
+	smallLen := len(small.mem)
+
+	large, err := c.highBWBufferOfSize(defaultHighBWBufferSize + 4096)
+	if err != nil {
+		t.Fatalf("highBWBufferOfSize(large): %v", err)
+	}
+
+	if len(large.mem) <= smallLen {
+		t.Fatalf("expected buffer to grow, got %d bytes after %d bytes", len(large.mem), smallLen)
+	}
+
+	if err := c.hbBuf.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"sync"
 	"unsafe"
 
 	"github.com/vmware/vmw-guestinfo/bdoor"
@@ -35,10 +36,24 @@ const (
 	messageStatusFail       = uint16(0x0000)
 	messageStatusSuccess    = uint16(0x0001)
 	messageStatusDoRecieve  = uint16(0x0002)
+	messageStatusUnknown    = uint16(0x0004)
 	messageStatusCheckPoint = uint16(0x0010)
 	messageStatusHighBW     = uint16(0x0080)
 )
 
+// isCheckpoint reports whether a backdoor status word signals that a
+// checkpoint occurred and the operation should be retried.
+func isCheckpoint(status uint16) bool {
+	return status&messageStatusCheckPoint != 0
+}
+
+// hostRejectsCookie reports whether a NewChannelWithOptions open failure's
+// status word signals that the host doesn't understand CommandFlagCookie,
+// as opposed to some other unrelated open failure.
+func hostRejectsCookie(status uint16) bool {
+	return status&messageStatusUnknown != 0
+}
+
 var (
 	// ErrChannelOpen represents a failure to open a channel
 	ErrChannelOpen = errors.New("could not open channel")
@@ -57,22 +72,63 @@ type Channel struct {
 	buf        []byte
 
 	cookie bdoor.UInt64
+
+	// hbBuf is a pinned, non-GC-managed bounce buffer used for
+	// high-bandwidth transfers. See SetHighBWBufferPool.
+	hbBuf *highBWBuffer
+
+	// mu serializes the SENDSIZE->SENDPAYLOAD and RECEIVESIZE->RECEIVEPAYLOAD
+	// sequences so concurrent callers can't interleave their halves of two
+	// different transfers on the same channel.
+	mu sync.Mutex
+}
+
+// ChannelOptions controls how NewChannelWithOptions opens a Channel.
+type ChannelOptions struct {
+	// ForceLowBandwidth disables the HighBandwidthIn/Out backdoor calls for
+	// this channel, even when the host advertises HighBW support. This
+	// mirrors the "force low bandwidth" capability check open-vm-tools
+	// performs on open.
+	ForceLowBandwidth bool
+
+	// ProtoVersion is the RPCI protocol/application identifier to open the
+	// channel with (the value historically passed as NewChannel's proto
+	// argument).
+	ProtoVersion uint32
+
+	// DisableCookie skips the CommandFlagCookie open attempt entirely,
+	// rather than probing for it and falling back.
+	DisableCookie bool
 }
 
-// NewChannel opens a new Channel
+// NewChannel opens a new Channel using the default options (cookie support
+// probed automatically, high bandwidth allowed).
 func NewChannel(proto uint32) (*Channel, error) {
+	return NewChannelWithOptions(ChannelOptions{ProtoVersion: proto})
+}
+
+// NewChannelWithOptions opens a new Channel with the given options. See
+// ChannelOptions for details.
+func NewChannelWithOptions(opts ChannelOptions) (*Channel, error) {
 	flags := bdoor.CommandFlagCookie
+	if opts.DisableCookie {
+		flags = 0
+	}
 
 retry:
 	bp := &bdoor.BackdoorProto{}
 
-	bp.BX.SetWord(proto | flags)
+	bp.BX.SetWord(opts.ProtoVersion | flags)
 	bp.CX.High = messageTypeOpen
 	bp.CX.Low = bdoor.CommandMessage
 
 	out := bp.InOut()
 	if (out.CX.High & messageStatusSuccess) == 0 {
-		if flags != 0 {
+		// Only drop the cookie flag and retry if the host explicitly told us
+		// it doesn't understand it; any other failure (e.g. a checkpoint
+		// racing the open) isn't a cookie problem and retrying without the
+		// flag wouldn't help. opts.ProtoVersion is untouched either way.
+		if flags != 0 && hostRejectsCookie(out.CX.High) {
 			flags = 0
 			goto retry
 		}
@@ -81,7 +137,7 @@ retry:
 		return nil, ErrChannelOpen
 	}
 
-	ch := &Channel{}
+	ch := &Channel{forceLowBW: opts.ForceLowBandwidth}
 	ch.id = out.DX.High
 	ch.cookie.High.SetWord(out.SI.Word())
 	ch.cookie.Low.SetWord(out.DI.Word())
@@ -91,6 +147,9 @@ retry:
 }
 
 func (c *Channel) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	bp := &bdoor.BackdoorProto{}
 
 	bp.CX.High = messageTypeClose
@@ -106,11 +165,18 @@ func (c *Channel) Close() error {
 		return ErrChannelClose
 	}
 
+	if err := c.hbBuf.Close(); err != nil {
+		Errorf("Message: Unable to release high-bandwidth buffer for channel %d: %s", c.id, err)
+	}
+
 	Debugf("Closed channel %d", c.id)
 	return nil
 }
 
 func (c *Channel) Send(buf []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 retry:
 	bp := &bdoor.BackdoorProto{}
 	bp.CX.High = messageTypeSendSize
@@ -125,6 +191,11 @@ retry:
 	// send the size
 	out := bp.InOut()
 	if (out.CX.High & messageStatusSuccess) == 0 {
+		if isCheckpoint(out.CX.High) {
+			Debugf("A checkpoint occurred. Retrying the operation")
+			goto retry
+		}
+
 		Errorf("Message: Unable to send a message over the communication channel %d", c.id)
 		return ErrRpciSend
 	}
@@ -135,6 +206,13 @@ retry:
 	}
 
 	if !c.forceLowBW && (out.CX.High&messageStatusHighBW) == messageStatusHighBW {
+		hb, err := c.highBWBufferOfSize(len(buf))
+		if err != nil {
+			Errorf("Message: Unable to allocate a high-bandwidth transfer buffer: %s", err)
+			return ErrRpciSend
+		}
+		copy(hb.mem, buf)
+
 		hbbp := &bdoor.BackdoorProto{}
 
 		hbbp.BX.Low = bdoor.CommandHighBWMessage
@@ -143,11 +221,11 @@ retry:
 		hbbp.BP.SetWord(c.cookie.High.Word())
 		hbbp.DI.SetWord(c.cookie.Low.Word())
 		hbbp.CX.SetWord(uint32(len(buf)))
-		hbbp.SI.SetWord(uint32(uintptr(unsafe.Pointer(&buf[0]))))
+		hbbp.SI.SetWord(uint32(uintptr(unsafe.Pointer(&hb.mem[0]))))
 
 		out := hbbp.HighBandwidthOut()
 		if (out.BX.High & messageStatusSuccess) == 0 {
-			if (out.BX.High & messageStatusCheckPoint) != 0 {
+			if isCheckpoint(out.BX.High) {
 				Debugf("A checkpoint occurred. Retrying the operation")
 				goto retry
 			}
@@ -180,6 +258,11 @@ retry:
 
 			out = bp.InOut()
 			if (out.CX.High & messageStatusSuccess) == 0 {
+				if isCheckpoint(out.CX.High) {
+					Debugf("A checkpoint occurred. Retrying the operation")
+					goto retry
+				}
+
 				Errorf("Message: Unable to send a message over the communication channel %d", c.id)
 				return ErrRpciSend
 			}
@@ -190,6 +273,9 @@ retry:
 }
 
 func (c *Channel) Receive() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 retry:
 	var err error
 	bp := &bdoor.BackdoorProto{}
@@ -202,6 +288,11 @@ retry:
 
 	out := bp.InOut()
 	if (out.CX.High & messageStatusSuccess) == 0 {
+		if isCheckpoint(out.CX.High) {
+			Debugf("A checkpoint occurred. Retrying the operation")
+			goto retry
+		}
+
 		Errorf("Message: Unable to poll for messages over the communication channel %d", c.id)
 		return nil, ErrRpciReceive
 	}
@@ -225,6 +316,13 @@ retry:
 		if !c.forceLowBW && (out.CX.High&messageStatusHighBW == messageStatusHighBW) {
 			buf = make([]byte, size)
 
+			hb, err := c.highBWBufferOfSize(len(buf))
+			if err != nil {
+				Errorf("Message: Unable to allocate a high-bandwidth transfer buffer: %s", err)
+				c.reply(messageTypeReceivePayload, messageStatusFail)
+				return nil, ErrRpciReceive
+			}
+
 			hbbp := &bdoor.BackdoorProto{}
 
 			hbbp.BX.Low = bdoor.CommandHighBWMessage
@@ -233,7 +331,7 @@ retry:
 			hbbp.SI.SetWord(c.cookie.High.Word())
 			hbbp.BP.SetWord(c.cookie.Low.Word())
 			hbbp.CX.SetWord(uint32(len(buf)))
-			hbbp.DI.SetWord(uint32(uintptr(unsafe.Pointer(&buf[0]))))
+			hbbp.DI.SetWord(uint32(uintptr(unsafe.Pointer(&hb.mem[0]))))
 
 			out := hbbp.HighBandwidthIn()
 			if (out.BX.High & messageStatusSuccess) == 0 {
@@ -241,6 +339,8 @@ retry:
 				c.reply(messageTypeReceivePayload, messageStatusFail)
 				return nil, ErrRpciReceive
 			}
+
+			copy(buf, hb.mem[:len(buf)])
 		} else {
 			b := bytes.NewBuffer(make([]byte, 0, size))
 
@@ -254,7 +354,7 @@ retry:
 
 				out = bp.InOut()
 				if (out.CX.High & messageStatusSuccess) == 0 {
-					if (out.CX.High & messageStatusCheckPoint) != 0 {
+					if isCheckpoint(out.CX.High) {
 						Debugf("A checkpoint occurred. Retrying the operation")
 						goto retry
 					}
@@ -0,0 +1,62 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import "testing"
+
+func TestIsCheckpoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		status uint16
+		want   bool
+	}{
+		{"plain success", messageStatusSuccess, false},
+		{"plain fail", messageStatusFail, false},
+		{"checkpoint alone", messageStatusCheckPoint, true},
+		{"checkpoint with highBW", messageStatusCheckPoint | messageStatusHighBW, true},
+		{"unknown alone", messageStatusUnknown, false},
+		{"doReceive alone", messageStatusDoRecieve, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isCheckpoint(tt.status); got != tt.want {
+				t.Errorf("isCheckpoint(%#04x) = %v, want %v", tt.status, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostRejectsCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		status uint16
+		want   bool
+	}{
+		{"plain success", messageStatusSuccess, false},
+		{"plain fail", messageStatusFail, false},
+		{"unknown alone", messageStatusUnknown, true},
+		{"unknown with highBW", messageStatusUnknown | messageStatusHighBW, true},
+		{"checkpoint alone", messageStatusCheckPoint, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hostRejectsCookie(tt.status); got != tt.want {
+				t.Errorf("hostRejectsCookie(%#04x) = %v, want %v", tt.status, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpcsvc
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"text/template"
+)
+
+// Command declares one RPCI command to generate a typed wrapper for.
+type Command struct {
+	// Name is the Go identifier for the generated wrapper function, e.g.
+	// "InfoGet".
+	Name string
+
+	// RPCI is the wire command this wrapper issues, e.g. "info-get".
+	RPCI string
+
+	// Stream selects a Stream-backed wrapper returning <-chan Frame instead
+	// of a Call-backed wrapper returning ([]byte, error). Use it for
+	// commands that can produce more than one reply.
+	Stream bool
+
+	// Doc, if set, becomes the wrapper's doc comment.
+	Doc string
+}
+
+var wrapperTemplate = template.Must(template.New("wrappers").Parse(`// Code generated by rpcsvc.Generate. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+
+	"github.com/vmware/vmw-guestinfo/rpcsvc"
+)
+{{range .Commands}}
+{{if .Doc}}// {{.Doc}}
+{{end -}}
+{{if .Stream}}func {{.Name}}(ctx context.Context, svc *rpcsvc.Service, args ...string) (<-chan rpcsvc.Frame, error) {
+	return svc.Stream(ctx, "{{.RPCI}}", args...)
+}
+{{else}}func {{.Name}}(ctx context.Context, svc *rpcsvc.Service, args ...string) ([]byte, error) {
+	return svc.Call(ctx, "{{.RPCI}}", args...)
+}
+{{end}}
+{{end}}`))
+
+// Generate renders gofmt'd Go source for package pkg containing one typed
+// wrapper function per Command, so callers get e.g. InfoGet(ctx, svc, key)
+// instead of having to spell out svc.Call(ctx, "info-get", key) themselves.
+func Generate(pkg string, commands []Command) ([]byte, error) {
+	var buf bytes.Buffer
+
+	data := struct {
+		Package  string
+		Commands []Command
+	}{pkg, commands}
+
+	if err := wrapperTemplate.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("rpcsvc: rendering wrappers: %w", err)
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("rpcsvc: formatting generated wrappers: %w", err)
+	}
+
+	return src, nil
+}
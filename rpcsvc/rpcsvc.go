@@ -0,0 +1,204 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rpcsvc layers typed request/response and streaming RPC calls on
+// top of message.Channel, and lets guest code serve host-initiated RPCs
+// instead of only originating them.
+package rpcsvc
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/vmw-guestinfo/message"
+)
+
+// servePollInterval is how long Serve waits between ReceiveContext polls
+// when nothing is pending, rather than spinning the backdoor port.
+const servePollInterval = 50 * time.Millisecond
+
+// Frame is one reply chunk of a streaming RPC.
+type Frame struct {
+	Data []byte
+	Err  error
+}
+
+// HandlerFunc serves a single host-initiated RPC command, returning the
+// reply to send back or an error to log and drop.
+type HandlerFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
+// Service multiplexes guest RPCs over a pooled set of Channels and lets
+// guest code register handlers for host-initiated commands such as
+// OS_Halt or Set_Option.
+type Service struct {
+	pool *message.ChannelPool
+
+	mu       sync.RWMutex
+	handlers map[string]HandlerFunc
+}
+
+// New creates a Service whose Channels are opened with proto and pooled up
+// to maxChannels concurrently open at once.
+func New(proto uint32, maxChannels int) *Service {
+	return &Service{
+		pool:     message.NewChannelPool(proto, maxChannels),
+		handlers: make(map[string]HandlerFunc),
+	}
+}
+
+// Call sends cmd (with args appended as a space-separated RPCI command, the
+// same wire format rpcvmx's one-shot calls use) and returns the single reply.
+func (s *Service) Call(ctx context.Context, cmd string, args ...string) ([]byte, error) {
+	ch, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.pool.Release(ch)
+
+	if err := ch.SendContext(ctx, buildCommand(cmd, args)); err != nil {
+		return nil, err
+	}
+
+	return ch.ReceiveContext(ctx)
+}
+
+// Stream sends cmd and returns a channel of reply Frames, for commands such
+// as a multi-line info-get dump or broadcastfd that produce more than one
+// reply. The returned channel is closed once the replies are exhausted, an
+// error occurs, or ctx is done; the last Frame delivered on error has Err
+// set and no Data.
+func (s *Service) Stream(ctx context.Context, cmd string, args ...string) (<-chan Frame, error) {
+	ch, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ch.SendContext(ctx, buildCommand(cmd, args)); err != nil {
+		s.pool.Release(ch)
+		return nil, err
+	}
+
+	frames := make(chan Frame)
+
+	go func() {
+		defer close(frames)
+		defer s.pool.Release(ch)
+
+		for {
+			data, err := ch.ReceiveContext(ctx)
+			if err != nil {
+				select {
+				case frames <- Frame{Err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+
+			if data == nil {
+				return
+			}
+
+			select {
+			case frames <- Frame{Data: data}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return frames, nil
+}
+
+// Handle registers fn to serve host-initiated RPC command cmd. It is safe to
+// call concurrently with a running Serve, including to register or replace a
+// handler after Serve has already started.
+func (s *Service) Handle(cmd string, fn HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[cmd] = fn
+}
+
+// handler looks up the HandlerFunc registered for cmd, if any.
+func (s *Service) handler(cmd string) (HandlerFunc, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fn, ok := s.handlers[cmd]
+	return fn, ok
+}
+
+// Serve opens a dedicated Channel and dispatches host-initiated RPCs to
+// their registered handlers until ctx is done or the channel errors.
+// Commands with no registered handler are acknowledged with an empty reply.
+func (s *Service) Serve(ctx context.Context, proto uint32) error {
+	ch, err := message.NewChannelContext(ctx, proto)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for {
+		payload, err := ch.ReceiveContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		if payload == nil {
+			// Nothing pending. Back off instead of hammering ReceiveSize in
+			// a tight loop.
+			select {
+			case <-time.After(servePollInterval):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		cmd, args := splitCommand(payload)
+
+		reply := []byte{}
+		if handler, ok := s.handler(cmd); ok {
+			reply, err = handler(ctx, args)
+			if err != nil {
+				log.Printf("rpcsvc: handler for %q failed: %s", cmd, err)
+				continue
+			}
+		}
+
+		if err := ch.SendContext(ctx, reply); err != nil {
+			return err
+		}
+	}
+}
+
+func buildCommand(cmd string, args []string) []byte {
+	if len(args) == 0 {
+		return []byte(cmd)
+	}
+
+	return []byte(cmd + " " + strings.Join(args, " "))
+}
+
+func splitCommand(payload []byte) (cmd string, args []byte) {
+	fields := strings.SplitN(string(payload), " ", 2)
+	if len(fields) == 1 {
+		return fields[0], nil
+	}
+
+	return fields[0], []byte(fields[1])
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpcsvc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestBuildCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  string
+		args []string
+		want string
+	}{
+		{"no args", "info-get", nil, "info-get"},
+		{"one arg", "info-get", []string{"GuestInfo.Foo"}, "info-get GuestInfo.Foo"},
+		{"multiple args", "log", []string{"guest", "message"}, "log guest message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(buildCommand(tt.cmd, tt.args)); got != tt.want {
+				t.Errorf("buildCommand(%q, %q) = %q, want %q", tt.cmd, tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		wantCmd  string
+		wantArgs []byte
+	}{
+		{"command only", "reset", "reset", nil},
+		{"command with one arg", "info-get GuestInfo.Foo", "info-get", []byte("GuestInfo.Foo")},
+		{"command with spaces in args", "log guest message here", "log", []byte("guest message here")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, args := splitCommand([]byte(tt.payload))
+			if cmd != tt.wantCmd {
+				t.Errorf("splitCommand(%q) cmd = %q, want %q", tt.payload, cmd, tt.wantCmd)
+			}
+			if !bytes.Equal(args, tt.wantArgs) {
+				t.Errorf("splitCommand(%q) args = %q, want %q", tt.payload, args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+// TestServiceHandleConcurrentWithDispatch exercises Handle and the dispatch
+// lookup Serve uses concurrently, the way go test -race is meant to catch a
+// map race registering handlers after Serve has already started.
+func TestServiceHandleConcurrentWithDispatch(t *testing.T) {
+	s := New(0, 1)
+
+	fn := func(ctx context.Context, payload []byte) ([]byte, error) {
+		return nil, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.Handle("cmd", fn)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		s.handler("cmd")
+	}
+
+	<-done
+}